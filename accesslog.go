@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// AccessLogConfig configures the access-log subsystem. It sits alongside
+// the Prometheus metrics middleware, which always runs, and is optional:
+// without an `access_log` block no access log is written.
+type AccessLogConfig struct {
+	// Path is the log file to append to.
+	Path string `yaml:"path"`
+	// Format is "combined" (human-readable, Apache-style) or "json"
+	// (one object per line, for shipping to ELK/Loki).
+	Format string `yaml:"format,omitempty"`
+	// BufferSize is how many log lines may queue before a slow disk
+	// starts dropping them instead of blocking requests.
+	BufferSize int `yaml:"buffer_size,omitempty"`
+	// SampleRate is the fraction (0-1] of requests that get logged.
+	// Defaults to 1.0 (log everything).
+	SampleRate float64 `yaml:"sample_rate,omitempty"`
+}
+
+func (c *AccessLogConfig) withDefaults() AccessLogConfig {
+	cfg := *c
+	if cfg.Format == "" {
+		cfg.Format = "combined"
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = 4096
+	}
+	if cfg.SampleRate <= 0 {
+		cfg.SampleRate = 1.0
+	}
+	return cfg
+}
+
+// backendCtxKey is the context key accessLogMiddleware uses to smuggle a
+// *backendCapture through httputil.ReverseProxy so a route's Director can
+// report which upstream URL actually served the request.
+type backendCtxKey struct{}
+
+// backendCapture is written by a proxy Director and read back by
+// accessLogMiddleware once the handler returns. httputil.ReverseProxy
+// clones the request before calling Director, so the value can't be
+// passed back through the request itself - a shared, mutex-guarded box
+// in the (preserved) context is what crosses that boundary.
+type backendCapture struct {
+	mu  sync.Mutex
+	url string
+}
+
+// recordBackendURL is called from a route's Director to report which
+// upstream it dispatched to, if the inbound request is being captured
+// for access logging.
+func recordBackendURL(req *http.Request, url string) {
+	capture, ok := req.Context().Value(backendCtxKey{}).(*backendCapture)
+	if !ok {
+		return
+	}
+	capture.mu.Lock()
+	capture.url = url
+	capture.mu.Unlock()
+}
+
+// accessLogWriter is a buffered, async, SIGHUP-aware sink for log lines.
+// A single goroutine owns the file descriptor so request-handling
+// goroutines never block on disk I/O; logrotate can safely rename the
+// file out from under Clara and send SIGHUP to make it reopen the path.
+type accessLogWriter struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+
+	lines chan []byte
+}
+
+func newAccessLogWriter(path string, bufferSize int) (*accessLogWriter, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("opening access log '%s': %w", path, err)
+	}
+
+	w := &accessLogWriter{
+		path:  path,
+		file:  f,
+		lines: make(chan []byte, bufferSize),
+	}
+	go w.run()
+	go w.watchSIGHUP()
+	return w, nil
+}
+
+func (w *accessLogWriter) run() {
+	for line := range w.lines {
+		w.mu.Lock()
+		if _, err := w.file.Write(line); err != nil {
+			logErrorf("access log: write to '%s' failed: %v", w.path, err)
+		}
+		w.mu.Unlock()
+	}
+}
+
+func (w *accessLogWriter) watchSIGHUP() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	for range sighup {
+		f, err := os.OpenFile(w.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			logErrorf("access log: failed to reopen '%s' after SIGHUP: %v", w.path, err)
+			continue
+		}
+		w.mu.Lock()
+		old := w.file
+		w.file = f
+		w.mu.Unlock()
+		old.Close()
+		logInfof("access log: reopened '%s' after SIGHUP", w.path)
+	}
+}
+
+// enqueue queues line for the writer goroutine, dropping it (with a log
+// line of its own) if the buffer is full rather than blocking the
+// request that produced it.
+func (w *accessLogWriter) enqueue(line []byte) {
+	select {
+	case w.lines <- line:
+	default:
+		logWarnf("access log: buffer full, dropping a log line")
+	}
+}
+
+// accessLogEntry is the set of fields captured for every logged request.
+type accessLogEntry struct {
+	Time      time.Time     `json:"time"`
+	ClientIP  string        `json:"client_ip"`
+	Method    string        `json:"method"`
+	Host      string        `json:"host"`
+	URI       string        `json:"uri"`
+	Proto     string        `json:"proto"`
+	Status    int           `json:"status"`
+	Bytes     int64         `json:"bytes"`
+	Duration  time.Duration `json:"duration_ms"`
+	Route     string        `json:"route"`
+	Service   string        `json:"service"`
+	Backend   string        `json:"backend,omitempty"`
+	Referer   string        `json:"referer,omitempty"`
+	UserAgent string        `json:"user_agent,omitempty"`
+}
+
+// MarshalJSON renders Duration as milliseconds rather than a
+// time.Duration string, which is what log shippers expect to aggregate
+// on.
+func (e accessLogEntry) MarshalJSON() ([]byte, error) {
+	type alias accessLogEntry
+	return json.Marshal(struct {
+		alias
+		Duration float64 `json:"duration_ms"`
+	}{alias: alias(e), Duration: float64(e.Duration.Microseconds()) / 1000})
+}
+
+// combinedLine renders e in an Apache/nginx "combined" log format line,
+// with duration appended in milliseconds since combined format has no
+// native field for it.
+func (e accessLogEntry) combinedLine() string {
+	referer := e.Referer
+	if referer == "" {
+		referer = "-"
+	}
+	agent := e.UserAgent
+	if agent == "" {
+		agent = "-"
+	}
+	return fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %d \"%s\" \"%s\" %.3f\n",
+		e.ClientIP, e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method, e.URI, e.Proto, e.Status, e.Bytes, referer, agent,
+		float64(e.Duration.Microseconds())/1000,
+	)
+}
+
+// accessLogMiddleware records one accessLogEntry per request (subject to
+// cfg.SampleRate) and hands it to writer for async, non-blocking disk
+// I/O.
+func accessLogMiddleware(cfg AccessLogConfig, writer *accessLogWriter, next http.Handler) http.Handler {
+	cfg = cfg.withDefaults()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.SampleRate < 1.0 && rand.Float64() >= cfg.SampleRate {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		capture := &backendCapture{}
+		r = r.WithContext(context.WithValue(r.Context(), backendCtxKey{}, capture))
+
+		var router *Router
+		if rtr, ok := app.router.Load().(*Router); ok {
+			router = rtr
+		}
+		routePath, serviceName := "unmatched", "unmatched"
+		var trustedProxies map[string]struct{}
+		if router != nil {
+			if match := router.findBestMatch(r.URL.Path); match != nil {
+				routePath, serviceName = match.path, match.service
+				trustedProxies = match.trustedProxies
+			}
+		}
+
+		res := NewResponseWriter(w)
+		start := time.Now()
+		next.ServeHTTP(res, r)
+		duration := time.Since(start)
+
+		capture.mu.Lock()
+		backendURL := capture.url
+		capture.mu.Unlock()
+
+		entry := accessLogEntry{
+			Time:      start,
+			ClientIP:  trustedClientIP(r, trustedProxies),
+			Method:    r.Method,
+			Host:      r.Host,
+			URI:       r.URL.RequestURI(),
+			Proto:     r.Proto,
+			Status:    res.statusCode,
+			Bytes:     res.bytesWritten,
+			Duration:  duration,
+			Route:     routePath,
+			Service:   serviceName,
+			Backend:   backendURL,
+			Referer:   r.Referer(),
+			UserAgent: r.UserAgent(),
+		}
+
+		var line []byte
+		if cfg.Format == "json" {
+			encoded, err := json.Marshal(entry)
+			if err != nil {
+				logErrorf("access log: failed to marshal entry: %v", err)
+				return
+			}
+			line = append(encoded, '\n')
+		} else {
+			line = []byte(entry.combinedLine())
+		}
+		writer.enqueue(line)
+	})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// addrSetting is a listener address resolved from multiple layers:
+// built-in default, then config.yaml's `server:` block, then a `CLARA_*`
+// environment variable, then a CLI flag - each layer only overrides what
+// it explicitly sets. FromFlagOrEnv records whether the flag or its env
+// var was explicitly set, since that's what decides whether main() lets
+// config.yaml's Server block override Value once it's loaded (a YAML
+// default needs to lose to an explicit flag/env value, but win over the
+// flag/env layer's own hardcoded default).
+type addrSetting struct {
+	Value         string
+	FromFlagOrEnv bool
+}
+
+// RuntimeConfig holds the settings resolved from CLI flags and their
+// `CLARA_*` environment variables: `-install`, the config path, the
+// listener addresses, TLS overrides and logging.
+type RuntimeConfig struct {
+	Install     bool
+	ConfigPath  string
+	HTTPAddr    addrSetting
+	HTTPSAddr   addrSetting
+	MetricsAddr addrSetting
+	TLSEmail    string
+	TLSDomains  []string
+	LogLevel    string
+	LogFormat   string
+}
+
+// runtimeConfig is populated once in main() and read by defaultConfigPaths
+// (provider.go) so the file provider honors --config / CLARA_CONFIG too.
+var runtimeConfig *RuntimeConfig
+
+func envOrDefault(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// parseRuntimeConfig builds a RuntimeConfig from defaults, `CLARA_*` env
+// vars, and args (normally os.Args[1:]). It returns flag.ErrHelp when
+// -h/--help was requested, matching flag.Parse's convention.
+func parseRuntimeConfig(args []string) (*RuntimeConfig, error) {
+	fs := flag.NewFlagSet("clara", flag.ContinueOnError)
+
+	install := fs.Bool("install", false, "Install Clara as a systemd service")
+	configPath := fs.String("config", envOrDefault("CLARA_CONFIG", ""), "Path to config.yaml, tried before the default search paths")
+	httpAddr := fs.String("http.addr", envOrDefault("CLARA_HTTP_ADDR", ":80"), "Address for the plaintext HTTP listener")
+	httpsAddr := fs.String("https.addr", envOrDefault("CLARA_HTTPS_ADDR", ":443"), "Address for the automatic HTTPS listener")
+	metricsAddr := fs.String("metrics.addr", envOrDefault("CLARA_METRICS_ADDR", ":9091"), "Address for the Prometheus /metrics and /debug/pprof server")
+	tlsEmail := fs.String("tls.email", envOrDefault("CLARA_TLS_EMAIL", ""), "Contact email for Let's Encrypt, overrides tls.email in config.yaml")
+	tlsDomains := fs.String("tls.domains", envOrDefault("CLARA_TLS_DOMAINS", ""), "Comma-separated domains to request certificates for, overrides tls.domains in config.yaml")
+	logLevel := fs.String("log.level", envOrDefault("CLARA_LOG_LEVEL", "info"), "Minimum log level: debug, info, warn, error")
+	logFormat := fs.String("log.format", envOrDefault("CLARA_LOG_FORMAT", "text"), "Log output format: text or json")
+
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintln(out, "Clara - a small, declarative reverse proxy")
+		fmt.Fprintln(out, "")
+		fmt.Fprintln(out, "Usage:")
+		fmt.Fprintln(out, "  clara [flags]")
+		fmt.Fprintln(out, "")
+		fmt.Fprintln(out, "Flags:")
+		fs.PrintDefaults()
+		fmt.Fprintln(out, "")
+		fmt.Fprintln(out, "Every flag except --install has a CLARA_* environment variable equivalent (e.g. --http.addr")
+		fmt.Fprintln(out, "is CLARA_HTTP_ADDR), used whenever the flag itself isn't passed. CLI flags")
+		fmt.Fprintln(out, "take priority over environment variables, which take priority over the")
+		fmt.Fprintln(out, "server: block in config.yaml, which takes priority over Clara's built-in")
+		fmt.Fprintln(out, "defaults. --log.level/--log.format have no config.yaml equivalent: they")
+		fmt.Fprintln(out, "control how Clara logs, not what it serves, so they're resolved before")
+		fmt.Fprintln(out, "any config is loaded.")
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	rc := &RuntimeConfig{
+		Install:    *install,
+		ConfigPath: *configPath,
+		HTTPAddr: addrSetting{
+			Value:         *httpAddr,
+			FromFlagOrEnv: explicit["http.addr"] || os.Getenv("CLARA_HTTP_ADDR") != "",
+		},
+		HTTPSAddr: addrSetting{
+			Value:         *httpsAddr,
+			FromFlagOrEnv: explicit["https.addr"] || os.Getenv("CLARA_HTTPS_ADDR") != "",
+		},
+		MetricsAddr: addrSetting{
+			Value:         *metricsAddr,
+			FromFlagOrEnv: explicit["metrics.addr"] || os.Getenv("CLARA_METRICS_ADDR") != "",
+		},
+		TLSEmail:  *tlsEmail,
+		LogLevel:  *logLevel,
+		LogFormat: *logFormat,
+	}
+	if *tlsDomains != "" {
+		rc.TLSDomains = strings.Split(*tlsDomains, ",")
+	}
+	return rc, nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var backendUpGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "clara_backend_up",
+	Help: "Whether a load-balanced backend is currently considered healthy (1) or not (0).",
+}, []string{"service", "url"})
+
+// HealthCheckConfig configures active and passive health checking for a
+// service's backends.
+type HealthCheckConfig struct {
+	// Path is GETed on each active probe. Any response under 500 counts
+	// as healthy.
+	Path string `yaml:"path,omitempty"`
+	// Interval between active probes.
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// Timeout for a single active probe.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// UnhealthyThreshold is how many consecutive failures (active or
+	// passive) mark a backend down.
+	UnhealthyThreshold int `yaml:"unhealthy_threshold,omitempty"`
+	// HealthyThreshold is how many consecutive active successes bring a
+	// down backend back up.
+	HealthyThreshold int `yaml:"healthy_threshold,omitempty"`
+}
+
+func (c *HealthCheckConfig) withDefaults() HealthCheckConfig {
+	cfg := *c
+	if cfg.Path == "" {
+		cfg.Path = "/"
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 10 * time.Second
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 2 * time.Second
+	}
+	if cfg.UnhealthyThreshold <= 0 {
+		cfg.UnhealthyThreshold = 3
+	}
+	if cfg.HealthyThreshold <= 0 {
+		cfg.HealthyThreshold = 2
+	}
+	return cfg
+}
+
+// Backend is a single proxy target behind a LoadBalancer. Its health flag
+// is flipped both by active probes (startHealthChecks) and by passively
+// observing proxied traffic (wirePassiveHealthCheck).
+type Backend struct {
+	URL   *url.URL
+	Proxy *httputil.ReverseProxy
+
+	// Weight is this backend's share of traffic under the
+	// weighted_round_robin strategy (see loadbalancer.go); it defaults to
+	// 1 and is otherwise parsed from a "#weight=N" suffix on its
+	// `servers` entry.
+	Weight int
+
+	healthy  atomic.Bool
+	inFlight atomic.Int64
+
+	mu            sync.Mutex
+	consecFail    int
+	consecSuccess int
+}
+
+// NewBackend returns a Backend that starts out healthy.
+func NewBackend(target *url.URL, proxy *httputil.ReverseProxy) *Backend {
+	b := &Backend{URL: target, Proxy: proxy, Weight: 1}
+	b.healthy.Store(true)
+	return b
+}
+
+// Healthy reports whether this backend should currently receive traffic.
+func (b *Backend) Healthy() bool { return b.healthy.Load() }
+
+// markDown reports whether this call actually transitioned the backend
+// from healthy to unhealthy (false if it was already down).
+func (b *Backend) markDown(service string) bool {
+	transitioned := b.healthy.CompareAndSwap(true, false)
+	if transitioned {
+		logWarnf("health check: backend %s for service '%s' marked unhealthy", b.URL, service)
+		backendUpGauge.WithLabelValues(service, b.URL.String()).Set(0)
+	}
+	return transitioned
+}
+
+func (b *Backend) markUp(service string) {
+	if b.healthy.CompareAndSwap(false, true) {
+		logInfof("health check: backend %s for service '%s' marked healthy", b.URL, service)
+		backendUpGauge.WithLabelValues(service, b.URL.String()).Set(1)
+	}
+}
+
+// passiveRecoveryCooldown is how long a backend with no active health
+// check configured stays down before passive observation alone gives it
+// another chance. Passive observation only ever marks a backend down -
+// without this, a service that doesn't opt into health_check would have
+// no path back to healthy after a single transient blip (a deploy
+// restart, a brief network hiccup), leaving it out of the pool for the
+// rest of the process's life.
+const passiveRecoveryCooldown = 30 * time.Second
+
+// recordPassive folds one proxied request's outcome into the backend's
+// consecutive-failure count, immediately marking it down on a burst of
+// 5xx responses or dial errors without waiting for the next active probe.
+// A default threshold of 5 is used since passive observation has no
+// configured HealthCheckConfig of its own. When selfHeal is set (the
+// service has no active health check of its own to eventually bring the
+// backend back), a down transition schedules a one-shot recovery after
+// passiveRecoveryCooldown.
+func (b *Backend) recordPassive(ctx context.Context, service string, failed bool, selfHeal bool) {
+	const passiveUnhealthyThreshold = 5
+
+	b.mu.Lock()
+	if !failed {
+		b.consecFail = 0
+		b.mu.Unlock()
+		return
+	}
+	b.consecFail++
+	shouldMarkDown := b.consecFail >= passiveUnhealthyThreshold
+	b.mu.Unlock()
+
+	if !shouldMarkDown {
+		return
+	}
+	if b.markDown(service) && selfHeal {
+		go b.recoverAfterCooldown(ctx, service)
+	}
+}
+
+// recoverAfterCooldown waits out passiveRecoveryCooldown (or ctx being
+// cancelled, which happens on the next config reload) and then marks b
+// healthy again so it gets a chance to take traffic. If it's still
+// failing, recordPassive will mark it down again after the next burst of
+// errors rather than waiting out another full cooldown's worth of 5xxs.
+func (b *Backend) recoverAfterCooldown(ctx context.Context, service string) {
+	timer := time.NewTimer(passiveRecoveryCooldown)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+		b.mu.Lock()
+		b.consecFail = 0
+		b.mu.Unlock()
+		b.markUp(service)
+	}
+}
+
+// wirePassiveHealthCheck hooks proxy's ModifyResponse and ErrorHandler so
+// 5xx responses and dial/transport errors count against backend's health,
+// independent of the active probe loop. ctx is the health-check lifetime
+// (cancelled on the next config reload); selfHeal should be true when the
+// service has no active health check of its own, so a passively-marked-down
+// backend still gets a chance to recover instead of being stuck until Clara
+// restarts.
+func wirePassiveHealthCheck(ctx context.Context, proxy *httputil.ReverseProxy, service string, backend *Backend, selfHeal bool) {
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		backend.recordPassive(ctx, service, resp.StatusCode >= 500, selfHeal)
+		return nil
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		backend.recordPassive(ctx, service, true, selfHeal)
+		logWarnf("backend %s for service '%s' proxy error: %v", backend.URL, service, err)
+		if rtr, ok := app.router.Load().(*Router); ok {
+			rtr.serveErrorPage(w, r, http.StatusBadGateway)
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+	}
+}
+
+// startHealthChecks spawns one goroutine per backend that actively GETs
+// cfg.Path every cfg.Interval. It exits when ctx is cancelled, which
+// happens when newRouter builds a replacement LoadBalancer on reload.
+func startHealthChecks(ctx context.Context, service string, backends []*Backend, cfg HealthCheckConfig) {
+	cfg = cfg.withDefaults()
+	client := &http.Client{Timeout: cfg.Timeout}
+
+	for _, b := range backends {
+		b := b
+		go func() {
+			ticker := time.NewTicker(cfg.Interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					probeBackend(client, service, b, cfg)
+				}
+			}
+		}()
+	}
+}
+
+func probeBackend(client *http.Client, service string, b *Backend, cfg HealthCheckConfig) {
+	checkURL := *b.URL
+	checkURL.Path = cfg.Path
+	resp, err := client.Get(checkURL.String())
+
+	ok := err == nil && resp.StatusCode < 500
+	if resp != nil {
+		resp.Body.Close()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ok {
+		b.consecSuccess++
+		b.consecFail = 0
+		if !b.Healthy() && b.consecSuccess >= cfg.HealthyThreshold {
+			b.markUp(service)
+		}
+	} else {
+		b.consecFail++
+		b.consecSuccess = 0
+		if b.Healthy() && b.consecFail >= cfg.UnhealthyThreshold {
+			b.markDown(service)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// lbStrategy picks a backend for each request and is notified once that
+// request has finished, so strategies that track in-flight work (e.g.
+// least_connections) can release their slot. Strategies that don't need
+// the callback implement done as a no-op.
+type lbStrategy interface {
+	pick(r *http.Request) *Backend
+	done(b *Backend)
+}
+
+// newLBStrategy builds the lbStrategy named by strategyName, falling back
+// to round-robin for an empty or unrecognized name.
+func newLBStrategy(strategyName string, svc Service, backends []*Backend) lbStrategy {
+	switch strategyName {
+	case "weighted_round_robin":
+		return newWeightedRoundRobin(backends)
+	case "least_connections":
+		return &leastConnections{backends: backends}
+	case "ip_hash":
+		return &ipHash{backends: backends, trustedProxies: toSet(svc.TrustedProxies)}
+	case "round_robin", "":
+		return newRoundRobin(backends)
+	default:
+		logWarnf("service '%s' requests unknown load_balancing_strategy '%s', falling back to round_robin.", svc.Name, strategyName)
+		return newRoundRobin(backends)
+	}
+}
+
+func toSet(values []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(values))
+	for _, v := range values {
+		set[v] = struct{}{}
+	}
+	return set
+}
+
+// parseServerEntry splits a `servers` entry like "http://a:80#weight=5"
+// into its base URL and weight. Entries without a "#weight=" suffix
+// default to weight 1.
+func parseServerEntry(entry string) (rawURL string, weight int) {
+	weight = 1
+	rawURL = entry
+	if idx := strings.Index(entry, "#weight="); idx != -1 {
+		rawURL = entry[:idx]
+		if w, err := strconv.Atoi(entry[idx+len("#weight="):]); err == nil && w > 0 {
+			weight = w
+		}
+	}
+	return rawURL, weight
+}
+
+// --- Round robin -------------------------------------------------------
+
+// roundRobin is Clara's original strategy: walk the backend list with an
+// atomic counter, skipping unhealthy backends.
+type roundRobin struct {
+	backends []*Backend
+	next     atomic.Uint64
+}
+
+func newRoundRobin(backends []*Backend) *roundRobin {
+	return &roundRobin{backends: backends}
+}
+
+// pick tries at most len(backends) times so an all-unhealthy pool
+// returns nil instead of looping forever.
+func (rr *roundRobin) pick(r *http.Request) *Backend {
+	n := len(rr.backends)
+	for i := 0; i < n; i++ {
+		idx := rr.next.Add(1) % uint64(n)
+		if b := rr.backends[idx]; b.Healthy() {
+			return b
+		}
+	}
+	return nil
+}
+
+func (rr *roundRobin) done(b *Backend) {}
+
+// --- Weighted round robin ------------------------------------------------
+
+// weightedRoundRobin implements smooth weighted round-robin: each backend
+// carries a current weight that grows by its configured weight every
+// pick, the highest current weight is chosen, and the total weight is
+// subtracted from the winner afterwards. Over time this spreads picks
+// proportionally to weight while still interleaving smoothly rather than
+// bursting all of one backend's share back-to-back.
+type weightedRoundRobin struct {
+	mu    sync.Mutex
+	items []*weightedItem
+}
+
+type weightedItem struct {
+	backend *Backend
+	weight  int
+	current int
+}
+
+func newWeightedRoundRobin(backends []*Backend) *weightedRoundRobin {
+	wrr := &weightedRoundRobin{}
+	for _, b := range backends {
+		weight := b.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		wrr.items = append(wrr.items, &weightedItem{backend: b, weight: weight})
+	}
+	return wrr
+}
+
+func (wrr *weightedRoundRobin) pick(r *http.Request) *Backend {
+	wrr.mu.Lock()
+	defer wrr.mu.Unlock()
+
+	total := 0
+	var best *weightedItem
+	for _, it := range wrr.items {
+		if !it.backend.Healthy() {
+			continue
+		}
+		it.current += it.weight
+		total += it.weight
+		if best == nil || it.current > best.current {
+			best = it
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	best.current -= total
+	return best.backend
+}
+
+func (wrr *weightedRoundRobin) done(b *Backend) {}
+
+// --- Least connections ----------------------------------------------------
+
+// leastConnections tracks in-flight requests per backend with an atomic
+// counter and always picks the healthy backend with the fewest. Ties
+// resolve to whichever backend is first in the list.
+type leastConnections struct {
+	backends []*Backend
+}
+
+func (lc *leastConnections) pick(r *http.Request) *Backend {
+	var best *Backend
+	var bestCount int64 = -1
+	for _, b := range lc.backends {
+		if !b.Healthy() {
+			continue
+		}
+		if count := b.inFlight.Load(); best == nil || count < bestCount {
+			best = b
+			bestCount = count
+		}
+	}
+	if best != nil {
+		best.inFlight.Add(1)
+	}
+	return best
+}
+
+func (lc *leastConnections) done(b *Backend) {
+	if b != nil {
+		b.inFlight.Add(-1)
+	}
+}
+
+// --- IP hash ----------------------------------------------------------
+
+// ipHash consistently hashes the client address into the backend slice so
+// the same client keeps landing on the same backend without needing a
+// sticky-session cookie. If the chosen backend is unhealthy it falls
+// through the remaining backends in hash order rather than failing the
+// request.
+type ipHash struct {
+	backends       []*Backend
+	trustedProxies map[string]struct{}
+}
+
+func (ih *ipHash) pick(r *http.Request) *Backend {
+	n := len(ih.backends)
+	if n == 0 {
+		return nil
+	}
+
+	key := ih.hashKey(r)
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	start := int(h.Sum32()) % n
+	if start < 0 {
+		start += n
+	}
+
+	for i := 0; i < n; i++ {
+		if b := ih.backends[(start+i)%n]; b.Healthy() {
+			return b
+		}
+	}
+	return nil
+}
+
+func (ih *ipHash) done(b *Backend) {}
+
+// hashKey returns the client identity to hash: the real client IP from
+// X-Forwarded-For when the immediate peer is a configured trusted proxy,
+// otherwise RemoteAddr.
+func (ih *ipHash) hashKey(r *http.Request) string {
+	return trustedClientIP(r, ih.trustedProxies)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+)
+
+func testBackend(t *testing.T, name string, weight int) *Backend {
+	t.Helper()
+	target, err := url.Parse("http://" + name)
+	if err != nil {
+		t.Fatalf("parsing test backend url: %v", err)
+	}
+	b := NewBackend(target, httputil.NewSingleHostReverseProxy(target))
+	b.Weight = weight
+	return b
+}
+
+func TestWeightedRoundRobinDistribution(t *testing.T) {
+	a := testBackend(t, "a", 5)
+	b := testBackend(t, "b", 1)
+	c := testBackend(t, "c", 1)
+
+	wrr := newWeightedRoundRobin([]*Backend{a, b, c})
+
+	const rounds = 700
+	counts := map[*Backend]int{}
+	for i := 0; i < rounds; i++ {
+		picked := wrr.pick(nil)
+		if picked == nil {
+			t.Fatalf("pick() returned nil with all backends healthy")
+		}
+		counts[picked]++
+	}
+
+	want := map[*Backend]float64{
+		a: float64(rounds) * 5.0 / 7.0,
+		b: float64(rounds) * 1.0 / 7.0,
+		c: float64(rounds) * 1.0 / 7.0,
+	}
+	const tolerance = 0.05 * rounds
+	for backend, wantCount := range want {
+		if got := float64(counts[backend]); math.Abs(got-wantCount) > tolerance {
+			t.Errorf("backend got %d picks, want ~%.0f (+/- %.0f)", counts[backend], wantCount, tolerance)
+		}
+	}
+}
+
+func TestWeightedRoundRobinSkipsUnhealthy(t *testing.T) {
+	a := testBackend(t, "a", 1)
+	b := testBackend(t, "b", 1)
+	b.healthy.Store(false)
+
+	wrr := newWeightedRoundRobin([]*Backend{a, b})
+	for i := 0; i < 10; i++ {
+		if picked := wrr.pick(nil); picked != a {
+			t.Fatalf("pick() = %v, want the only healthy backend", picked)
+		}
+	}
+}
+
+func TestLeastConnectionsPicksFewestInFlight(t *testing.T) {
+	a := testBackend(t, "a", 1)
+	b := testBackend(t, "b", 1)
+	lc := &leastConnections{backends: []*Backend{a, b}}
+
+	first := lc.pick(nil)
+	if first != a {
+		t.Fatalf("first pick = %v, want a (tie broken by list order)", first)
+	}
+
+	second := lc.pick(nil)
+	if second != b {
+		t.Fatalf("second pick = %v, want b (fewer in-flight than a)", second)
+	}
+
+	lc.done(first)
+	lc.done(second)
+
+	if a.inFlight.Load() != 0 || b.inFlight.Load() != 0 {
+		t.Fatalf("in-flight counts did not return to zero after done(): a=%d b=%d", a.inFlight.Load(), b.inFlight.Load())
+	}
+}
+
+func TestIPHashStickiness(t *testing.T) {
+	backends := []*Backend{testBackend(t, "a", 1), testBackend(t, "b", 1), testBackend(t, "c", 1)}
+	ih := &ipHash{backends: backends}
+
+	r1 := httptest.NewRequest(http.MethodGet, "/", nil)
+	r1.RemoteAddr = "203.0.113.5:54321"
+	first := ih.pick(r1)
+
+	for i := 0; i < 10; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "203.0.113.5:9999" // same IP, different port
+		if picked := ih.pick(r); picked != first {
+			t.Fatalf("ip_hash picked a different backend for the same client IP on attempt %d", i)
+		}
+	}
+}
+
+func TestIPHashHonorsTrustedProxyForwardedFor(t *testing.T) {
+	backends := []*Backend{testBackend(t, "a", 1), testBackend(t, "b", 1), testBackend(t, "c", 1)}
+	ih := &ipHash{backends: backends, trustedProxies: map[string]struct{}{"10.0.0.1": {}}}
+
+	viaTrustedProxy := httptest.NewRequest(http.MethodGet, "/", nil)
+	viaTrustedProxy.RemoteAddr = "10.0.0.1:12345"
+	viaTrustedProxy.Header.Set("X-Forwarded-For", "198.51.100.9, 10.0.0.1")
+
+	direct := httptest.NewRequest(http.MethodGet, "/", nil)
+	direct.RemoteAddr = "198.51.100.9:9999"
+
+	if ih.hashKey(viaTrustedProxy) != ih.hashKey(direct) {
+		t.Fatalf("a trusted proxy's X-Forwarded-For should resolve to the same hash key as a direct connection from that client")
+	}
+	if ih.pick(viaTrustedProxy) != ih.pick(direct) {
+		t.Fatalf("ip_hash should route the same real client to the same backend whether or not it came through a trusted proxy")
+	}
+
+	spoofed := httptest.NewRequest(http.MethodGet, "/", nil)
+	spoofed.RemoteAddr = "203.0.113.77:9999" // not in trustedProxies
+	spoofed.Header.Set("X-Forwarded-For", "198.51.100.9")
+
+	if key := ih.hashKey(spoofed); key != "203.0.113.77" {
+		t.Fatalf("an untrusted peer's X-Forwarded-For should be ignored, got hash key %q", key)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// logLevel is the minimum severity a log line needs to be emitted.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+func parseLogLevel(s string) logLevel {
+	switch strings.ToLower(s) {
+	case "debug":
+		return levelDebug
+	case "warn", "warning":
+		return levelWarn
+	case "error":
+		return levelError
+	default:
+		return levelInfo
+	}
+}
+
+func (l logLevel) String() string {
+	switch l {
+	case levelDebug:
+		return "debug"
+	case levelWarn:
+		return "warn"
+	case levelError:
+		return "error"
+	default:
+		return "info"
+	}
+}
+
+// minLogLevel and jsonLogFormat are set once by configureLogging, called
+// from main() before any other goroutine starts, from --log.level/
+// --log.format (and their CLARA_* env equivalents). They're read without
+// synchronization afterwards, same as runtimeConfig.
+var (
+	minLogLevel   = levelInfo
+	jsonLogFormat = false
+)
+
+// configureLogging applies --log.level/--log.format. It must run before
+// any goroutine that might log starts, since minLogLevel/jsonLogFormat
+// are read unsynchronized from then on.
+func configureLogging(level, format string) {
+	minLogLevel = parseLogLevel(level)
+	jsonLogFormat = strings.EqualFold(format, "json")
+	if jsonLogFormat {
+		// logf writes the full JSON line itself below; drop the standard
+		// logger's own date/time prefix so lines aren't double-stamped.
+		log.SetFlags(0)
+	}
+}
+
+// logf emits a message at level if it meets minLogLevel, either as plain
+// text (preserving every existing call site's wording) or as one JSON
+// object per line for log shippers.
+func logf(level logLevel, format string, args ...interface{}) {
+	if level < minLogLevel {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if !jsonLogFormat {
+		log.Print(msg)
+		return
+	}
+	line, err := json.Marshal(struct {
+		Time  time.Time `json:"time"`
+		Level string    `json:"level"`
+		Msg   string    `json:"msg"`
+	}{Time: time.Now(), Level: level.String(), Msg: msg})
+	if err != nil {
+		log.Print(msg)
+		return
+	}
+	os.Stderr.Write(append(line, '\n'))
+}
+
+func logDebugf(format string, args ...interface{}) { logf(levelDebug, format, args...) }
+func logInfof(format string, args ...interface{})  { logf(levelInfo, format, args...) }
+func logWarnf(format string, args ...interface{})  { logf(levelWarn, format, args...) }
+func logErrorf(format string, args ...interface{}) { logf(levelError, format, args...) }
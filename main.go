@@ -25,17 +25,13 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/crypto/acme/autocert"
-	"gopkg.in/yaml.v2"
 )
 
 //go:embed defaults
 var defaultPages embed.FS
 
 // --- Global Application State ---
-var (
-	app    = &App{}
-	config Config
-)
+var app = &App{}
 
 // --- Buffer Pool Adapter ---
 // This adapter makes our sync.Pool compatible with httputil.BufferPool
@@ -81,21 +77,46 @@ type Service struct {
 	Port                  int      `yaml:"port,omitempty"`
 	LoadBalancingStrategy string   `yaml:"load_balancing_strategy,omitempty"`
 	Servers               []string `yaml:"servers,omitempty"`
+
+	// Middlewares lists, in order, the middleware names to wrap this
+	// service's handler with (e.g. "circuit_breaker", "rate_limit",
+	// "retry"). See buildMiddlewareChain in middleware.go.
+	Middlewares    []string              `yaml:"middlewares,omitempty"`
+	CircuitBreaker *CircuitBreakerConfig `yaml:"circuit_breaker,omitempty"`
+	RateLimit      *RateLimitConfig      `yaml:"rate_limit,omitempty"`
+	Retry          *RetryConfig          `yaml:"retry,omitempty"`
+	HealthCheck    *HealthCheckConfig    `yaml:"health_check,omitempty"`
+
+	// TrustedProxies lists upstream proxy addresses whose X-Forwarded-For
+	// header is honored: for a request whose immediate peer is one of
+	// them, the ip_hash strategy and access logging take the header's
+	// first address as the client instead of RemoteAddr.
+	TrustedProxies []string `yaml:"trusted_proxies,omitempty"`
 }
 
-// LoadBalancer holds the logic for a round-robin setup.
+// LoadBalancer distributes requests across a service's backends,
+// skipping any currently marked unhealthy by health.go. The actual
+// selection algorithm is pluggable; see loadbalancer.go for the
+// lbStrategy implementations (round-robin, weighted round-robin,
+// least-connections, ip-hash).
 type LoadBalancer struct {
-	backends []*httputil.ReverseProxy
-	mu       sync.Mutex
-	next     int
+	service  string
+	backends []*Backend
+	strategy lbStrategy
 }
 
 func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	lb.mu.Lock()
-	backend := lb.backends[lb.next%len(lb.backends)]
-	lb.next++
-	lb.mu.Unlock()
-	backend.ServeHTTP(w, r)
+	backend := lb.strategy.pick(r)
+	if backend == nil {
+		if rtr, ok := app.router.Load().(*Router); ok {
+			rtr.serveErrorPage(w, r, http.StatusServiceUnavailable)
+		} else {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		}
+		return
+	}
+	defer lb.strategy.done(backend)
+	backend.Proxy.ServeHTTP(w, r)
 }
 
 // Route defines how to handle incoming requests.
@@ -110,17 +131,36 @@ type TLS struct {
 	Domains []string `yaml:"domains"`
 }
 
-// Config represents the structure of your config.yaml file.
+// ServerConfig is the config.yaml layer for the listener addresses that
+// flags.go also exposes as --http.addr/--https.addr/--metrics.addr (and
+// their CLARA_* env equivalents). It only takes effect when neither the
+// flag nor its env var was explicitly set - see parseRuntimeConfig and
+// main's layering of addrSetting.FromFlagOrEnv.
+type ServerConfig struct {
+	HTTPAddr    string `yaml:"http_addr,omitempty"`
+	HTTPSAddr   string `yaml:"https_addr,omitempty"`
+	MetricsAddr string `yaml:"metrics_addr,omitempty"`
+}
+
+// Config represents the merged routing table Clara serves at any moment. It
+// may be assembled from a single YAML file or merged from several
+// Providers (see provider.go).
 type Config struct {
-	ErrorPages map[int]string `yaml:"error_pages"`
-	TLS        *TLS           `yaml:"tls"`
-	Services   []Service      `yaml:"services"`
-	Routes     []Route        `yaml:"routes"`
+	ErrorPages map[int]string   `yaml:"error_pages"`
+	TLS        *TLS             `yaml:"tls"`
+	Services   []Service        `yaml:"services"`
+	Routes     []Route          `yaml:"routes"`
+	Providers  ProviderConfig   `yaml:"providers"`
+	AccessLog  *AccessLogConfig `yaml:"access_log,omitempty"`
+	Server     *ServerConfig    `yaml:"server,omitempty"`
 }
 
 // App holds the current application state.
 type App struct {
 	router atomic.Value
+
+	healthMu     sync.Mutex
+	stopHealthCk context.CancelFunc
 }
 
 // Router represents our dynamic routing table.
@@ -133,16 +173,22 @@ type routeHandler struct {
 	path    string
 	service string
 	handler http.Handler
+
+	// trustedProxies mirrors the matched service's TrustedProxies, so
+	// accessLogMiddleware can honor X-Forwarded-For the same way the
+	// ip_hash strategy does instead of trusting it unconditionally.
+	trustedProxies map[string]struct{}
 }
 
-// Custom responseWriter to get the status code
+// Custom responseWriter to get the status code and bytes written.
 type responseWriter struct {
 	http.ResponseWriter
-	statusCode int
+	statusCode   int
+	bytesWritten int64
 }
 
 func NewResponseWriter(w http.ResponseWriter) *responseWriter {
-	return &responseWriter{w, http.StatusOK}
+	return &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
 }
 
 func (rw *responseWriter) WriteHeader(code int) {
@@ -150,6 +196,12 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytesWritten += int64(n)
+	return n, err
+}
+
 // metricsMiddleware wraps an http.Handler to record Prometheus metrics.
 func metricsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -187,7 +239,7 @@ func (r *Router) serveErrorPage(w http.ResponseWriter, req *http.Request, status
 			w.Write(htmlBytes)
 			return
 		}
-		log.Printf("Warning: Failed to read custom error page '%s': %v", pagePath, err)
+		logWarnf("Failed to read custom error page '%s': %v", pagePath, err)
 	}
 
 	defaultPagePath := fmt.Sprintf("defaults/%d.html", statusCode)
@@ -238,12 +290,12 @@ func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	bestMatch := r.findBestMatch(req.URL.Path)
 
 	if bestMatch != nil {
-		log.Printf("Clara received request for '%s', proxying to service '%s' (match: '%s')", req.URL.Path, bestMatch.service, bestMatch.path)
+		logDebugf("Clara received request for '%s', proxying to service '%s' (match: '%s')", req.URL.Path, bestMatch.service, bestMatch.path)
 		bestMatch.handler.ServeHTTP(w, req)
 		return
 	}
 
-	log.Printf("Clara received request for '%s' - no matching route found, returning 404", req.URL.Path)
+	logDebugf("Clara received request for '%s' - no matching route found, returning 404", req.URL.Path)
 	r.serveErrorPage(w, req, http.StatusNotFound)
 }
 
@@ -254,6 +306,14 @@ func (a *App) newRouter(config *Config) *Router {
 	}
 	serviceMap := make(map[string]Service)
 
+	a.healthMu.Lock()
+	if a.stopHealthCk != nil {
+		a.stopHealthCk()
+	}
+	healthCtx, cancel := context.WithCancel(context.Background())
+	a.stopHealthCk = cancel
+	a.healthMu.Unlock()
+
 	transport := &http.Transport{
 		MaxIdleConns:        100,
 		MaxIdleConnsPerHost: 10,
@@ -272,18 +332,19 @@ func (a *App) newRouter(config *Config) *Router {
 	for _, route := range config.Routes {
 		svc, exists := serviceMap[route.Service]
 		if !exists {
-			log.Printf("Warning: Route for path '%s' references a service '%s' that does not exist.", route.Path, route.Service)
+			logWarnf("Route for path '%s' references a service '%s' that does not exist.", route.Path, route.Service)
 			continue
 		}
 
 		var handler http.Handler
 
 		if len(svc.Servers) > 0 {
-			lb := &LoadBalancer{}
+			lb := &LoadBalancer{service: svc.Name}
 			for _, serverURL := range svc.Servers {
-				target, err := url.Parse(serverURL)
+				rawURL, weight := parseServerEntry(serverURL)
+				target, err := url.Parse(rawURL)
 				if err != nil {
-					log.Printf("Warning: Failed to parse target URL '%s' for service '%s': %v", serverURL, svc.Name, err)
+					logWarnf("Failed to parse target URL '%s' for service '%s': %v", serverURL, svc.Name, err)
 					continue
 				}
 				proxy := httputil.NewSingleHostReverseProxy(target)
@@ -304,17 +365,30 @@ func (a *App) newRouter(config *Config) *Router {
 
 					req.URL.Path = targetPath
 					req.RequestURI = ""
+					recordBackendURL(req, target.String())
 				}
-				lb.backends = append(lb.backends, proxy)
+
+				backend := NewBackend(target, proxy)
+				backend.Weight = weight
+				wirePassiveHealthCheck(healthCtx, proxy, svc.Name, backend, svc.HealthCheck == nil)
+				lb.backends = append(lb.backends, backend)
 			}
 			if len(lb.backends) > 0 {
+				strategyName := svc.LoadBalancingStrategy
+				if strategyName == "" {
+					strategyName = "round_robin"
+				}
+				lb.strategy = newLBStrategy(strategyName, svc, lb.backends)
 				handler = lb
-				log.Printf("Initialized round-robin load balancer for service '%s' with %d servers.", svc.Name, len(lb.backends))
+				logInfof("Initialized '%s' load balancer for service '%s' with %d servers.", strategyName, svc.Name, len(lb.backends))
+				if svc.HealthCheck != nil {
+					startHealthChecks(healthCtx, svc.Name, lb.backends, *svc.HealthCheck)
+				}
 			}
 		} else if svc.Host != "" {
 			targetURL, err := url.Parse(fmt.Sprintf("http://%s:%d", svc.Host, svc.Port))
 			if err != nil {
-				log.Printf("Warning: Failed to parse target URL for service '%s': %v", svc.Name, err)
+				logWarnf("Failed to parse target URL for service '%s': %v", svc.Name, err)
 				continue
 			}
 			proxy := httputil.NewSingleHostReverseProxy(targetURL)
@@ -335,15 +409,18 @@ func (a *App) newRouter(config *Config) *Router {
 
 				req.URL.Path = targetPath
 				req.RequestURI = ""
+				recordBackendURL(req, targetURL.String())
 			}
 			handler = proxy
 		}
 
 		if handler != nil {
+			handler = buildMiddlewareChain(healthCtx, svc, handler)
 			router.routes = append(router.routes, routeHandler{
-				path:    route.Path,
-				service: route.Service,
-				handler: handler,
+				path:           route.Path,
+				service:        route.Service,
+				handler:        handler,
+				trustedProxies: toSet(svc.TrustedProxies),
 			})
 		}
 	}
@@ -351,99 +428,85 @@ func (a *App) newRouter(config *Config) *Router {
 	return router
 }
 
-func loadAndServeConfig() error {
-	configPaths := []string{
-		"./config.yaml",
-		os.Getenv("HOME") + "/.config/clara/config.yaml",
-		"/etc/clara/config.yaml",
-	}
-
-	var data []byte
-	var err error
-	foundPath := ""
-
-	for _, path := range configPaths {
-		data, err = os.ReadFile(path)
-		if err == nil {
-			foundPath = path
-			break
-		}
-	}
-
-	if foundPath == "" {
-		log.Println("No user-provided config found. Loading built-in default configuration.")
-		data, err = defaultPages.ReadFile("defaults/config.default.yaml")
-		if err != nil {
-			return fmt.Errorf("failed to load embedded default config: %w", err)
+func main() {
+	rc, err := parseRuntimeConfig(os.Args[1:])
+	if err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(0)
 		}
-	} else {
-		log.Printf("Loading configuration from: %s", foundPath)
-	}
-
-	if err := yaml.Unmarshal(data, &config); err != nil {
-		return fmt.Errorf("error parsing config: %w", err)
+		log.Fatalf("Failed to parse flags: %v", err)
 	}
-	app.router.Store(app.newRouter(&config))
-	return nil
-}
-
-func main() {
-	install := flag.Bool("install", false, "Install Clara as a systemd service")
-	flag.Parse()
+	runtimeConfig = rc
+	configureLogging(rc.LogLevel, rc.LogFormat)
+	logInfof("Clara starting (log.level=%s log.format=%s)", rc.LogLevel, rc.LogFormat)
 
-	if *install {
+	if rc.Install {
 		if err := installService(); err != nil {
 			log.Fatalf("Service installation failed: %v", err)
 		}
 		return
 	}
 
-	if err := loadAndServeConfig(); err != nil {
-		log.Fatalf("Initial config load failed: %v", err)
+	providersCtx, stopProviders := context.WithCancel(context.Background())
+	defer stopProviders()
+
+	// runProviders owns app.router from here on, keeping it current as
+	// providers emit updates. The first value it publishes is also the
+	// startup snapshot main() needs for TLS and access-log setup - there
+	// is no separate bootstrap read of config.yaml beforehand, and no
+	// shared mutable Config that both main() and the provider loop would
+	// otherwise need to synchronize over.
+	updates := runProviders(providersCtx)
+	initialConfig, ok := <-updates
+	if !ok {
+		log.Fatalf("provider loop exited before producing an initial configuration")
 	}
-
 	go func() {
-		var lastModTime time.Time
-		configPath := ""
-
-		searchPaths := []string{"./config.yaml", os.Getenv("HOME") + "/.config/clara/config.yaml", "/etc/clara/config.yaml"}
-		for _, path := range searchPaths {
-			if stat, err := os.Stat(path); err == nil {
-				configPath = path
-				lastModTime = stat.ModTime()
-				break
-			}
+		for range updates {
+			// app.router is already kept current by runProviders; this
+			// just keeps its internal loop from blocking on an unread send.
 		}
+	}()
 
-		if configPath == "" {
-			return
+	tls := initialConfig.TLS
+	if rc.TLSEmail != "" || len(rc.TLSDomains) > 0 {
+		if tls == nil {
+			tls = &TLS{}
+		} else {
+			overridden := *tls
+			tls = &overridden
+		}
+		if rc.TLSEmail != "" {
+			tls.Email = rc.TLSEmail
+		}
+		if len(rc.TLSDomains) > 0 {
+			tls.Domains = rc.TLSDomains
 		}
+	}
 
-		for {
-			time.Sleep(3 * time.Second)
-			stat, err := os.Stat(configPath)
-			if err != nil {
-				log.Printf("Error stating config file '%s': %v", configPath, err)
-				continue
-			}
-			if stat.ModTime() != lastModTime {
-				log.Printf("Change detected in %s, reloading...", configPath)
-				if err := loadAndServeConfig(); err != nil {
-					log.Printf("Config reload failed: %v", err)
-				} else {
-					log.Println("Clara has reloaded the configuration successfully.")
-				}
-				lastModTime = stat.ModTime()
-			}
+	// http.addr/https.addr/metrics.addr follow defaults -> config.yaml's
+	// server: block -> CLARA_* env vars -> CLI flags. The env/flag layers
+	// are already folded into rc by parseRuntimeConfig; config.yaml only
+	// gets a say when neither of those explicitly set a value.
+	httpAddr, httpsAddr, metricsAddr := rc.HTTPAddr.Value, rc.HTTPSAddr.Value, rc.MetricsAddr.Value
+	if srv := initialConfig.Server; srv != nil {
+		if !rc.HTTPAddr.FromFlagOrEnv && srv.HTTPAddr != "" {
+			httpAddr = srv.HTTPAddr
 		}
-	}()
+		if !rc.HTTPSAddr.FromFlagOrEnv && srv.HTTPSAddr != "" {
+			httpsAddr = srv.HTTPSAddr
+		}
+		if !rc.MetricsAddr.FromFlagOrEnv && srv.MetricsAddr != "" {
+			metricsAddr = srv.MetricsAddr
+		}
+	}
 
 	go func() {
 		metricsMux := http.NewServeMux()
 		metricsMux.Handle("/metrics", promhttp.Handler())
 		metricsMux.HandleFunc("/debug/pprof/", pprof.Index)
-		log.Println("Starting metrics server on :9091")
-		if err := http.ListenAndServe(":9091", metricsMux); err != nil {
+		logInfof("Starting metrics server on %s", metricsAddr)
+		if err := http.ListenAndServe(metricsAddr, metricsMux); err != nil {
 			log.Fatalf("Metrics server failed: %v", err)
 		}
 	}()
@@ -456,45 +519,55 @@ func main() {
 		}
 	}
 
-	wrappedHandler := metricsMiddleware(http.HandlerFunc(mainHandler))
+	var wrappedHandler http.Handler = http.HandlerFunc(mainHandler)
+	wrappedHandler = metricsMiddleware(wrappedHandler)
+
+	if initialConfig.AccessLog != nil {
+		accessLogCfg := initialConfig.AccessLog.withDefaults()
+		logWriter, err := newAccessLogWriter(accessLogCfg.Path, accessLogCfg.BufferSize)
+		if err != nil {
+			log.Fatalf("Failed to open access log: %v", err)
+		}
+		wrappedHandler = accessLogMiddleware(*initialConfig.AccessLog, logWriter, wrappedHandler)
+	}
 
 	var server *http.Server
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
 
-	if config.TLS != nil && len(config.TLS.Domains) > 0 {
-		log.Println("TLS is configured. Setting up Automatic HTTPS...")
+	if tls != nil && len(tls.Domains) > 0 {
+		logInfof("TLS is configured. Setting up Automatic HTTPS...")
 
 		certManager := &autocert.Manager{
 			Prompt:     autocert.AcceptTOS,
-			HostPolicy: autocert.HostWhitelist(config.TLS.Domains...),
+			HostPolicy: autocert.HostWhitelist(tls.Domains...),
 			Cache:      autocert.DirCache("certs"),
-			Email:      config.TLS.Email,
+			Email:      tls.Email,
 		}
 
 		server = &http.Server{
-			Addr:      ":443",
+			Addr:      httpsAddr,
 			Handler:   wrappedHandler,
 			TLSConfig: certManager.TLSConfig(),
 		}
 
 		go func() {
-			log.Println("Starting HTTP server on :80 for ACME challenges and redirects.")
-			if err := http.ListenAndServe(":80", certManager.HTTPHandler(nil)); err != nil {
-				log.Printf("HTTP server for ACME challenges failed: %v", err)
+			logInfof("Starting HTTP server on %s for ACME challenges and redirects.", httpAddr)
+			if err := http.ListenAndServe(httpAddr, certManager.HTTPHandler(nil)); err != nil {
+				logErrorf("HTTP server for ACME challenges failed: %v", err)
 			}
 		}()
 
 		go func() {
-			log.Println("Clara is ready. Starting HTTPS server on :443")
+			logInfof("Clara is ready. Starting HTTPS server on %s", httpsAddr)
 			if err := server.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
 				log.Fatalf("HTTPS Server ListenAndServeTLS: %v", err)
 			}
 		}()
 	} else {
-		log.Println("Clara is ready. Starting HTTP server on :80")
+		logInfof("Clara is ready. Starting HTTP server on %s", httpAddr)
 		server = &http.Server{
-			Addr:    ":80",
+			Addr:    httpAddr,
 			Handler: wrappedHandler,
 		}
 
@@ -506,7 +579,7 @@ func main() {
 	}
 
 	<-stop
-	log.Println("Shutting down Clara...")
+	logInfof("Shutting down Clara...")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -515,5 +588,5 @@ func main() {
 		log.Fatalf("Graceful shutdown failed: %v", err)
 	}
 
-	log.Println("Clara has gracefully shut down.")
+	logInfof("Clara has gracefully shut down.")
 }
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// --- Metrics Definitions -----------------------------------------------------
+
+var (
+	circuitStateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "clara_circuit_state",
+		Help: "Circuit breaker state per service (0=closed, 1=half-open, 2=open).",
+	}, []string{"service"})
+
+	rateLimitedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "clara_rate_limited_total",
+		Help: "Total number of requests rejected by the rate limiter.",
+	}, []string{"service"})
+)
+
+// Middleware wraps an http.Handler with additional behavior, the same
+// shape metricsMiddleware already uses.
+type Middleware func(http.Handler) http.Handler
+
+// buildMiddlewareChain wraps handler with the middlewares named in
+// svc.Middlewares, in the order they're listed, innermost (closest to
+// handler) first. Unknown names are logged and skipped so a typo in
+// config.yaml doesn't take the route down entirely. ctx bounds the
+// lifetime of any background goroutine a middleware starts (e.g. the
+// rate limiter's bucket reaper); it's cancelled on the next config
+// reload, same as healthCtx in main.go.
+func buildMiddlewareChain(ctx context.Context, svc Service, handler http.Handler) http.Handler {
+	for _, name := range svc.Middlewares {
+		switch name {
+		case "circuit_breaker":
+			cfg := svc.CircuitBreaker
+			if cfg == nil {
+				cfg = &CircuitBreakerConfig{}
+			}
+			handler = newCircuitBreaker(svc.Name, *cfg).wrap(handler)
+		case "rate_limit":
+			cfg := svc.RateLimit
+			if cfg == nil {
+				cfg = &RateLimitConfig{}
+			}
+			handler = newRateLimiter(ctx, svc.Name, *cfg).wrap(handler)
+		case "retry":
+			cfg := svc.Retry
+			if cfg == nil {
+				cfg = &RetryConfig{}
+			}
+			handler = retryMiddleware(*cfg)(handler)
+		default:
+			logWarnf("service '%s' requests unknown middleware '%s', skipping.", svc.Name, name)
+		}
+	}
+	return handler
+}
+
+// --- Circuit breaker ---------------------------------------------------------
+
+// CircuitBreakerConfig configures a per-service circuit breaker.
+type CircuitBreakerConfig struct {
+	// WindowSize is how many of the most recent responses are considered
+	// when computing the error ratio / p95 latency.
+	WindowSize int `yaml:"window_size,omitempty"`
+	// ErrorThreshold is the 5xx ratio (0-1) over the window that trips the
+	// breaker.
+	ErrorThreshold float64 `yaml:"error_threshold,omitempty"`
+	// LatencyThreshold, if set, also trips the breaker once p95 latency
+	// over the window exceeds it.
+	LatencyThreshold time.Duration `yaml:"latency_threshold,omitempty"`
+	// RecoveryTimeout is how long the breaker stays open before allowing a
+	// single half-open probe request through.
+	RecoveryTimeout time.Duration `yaml:"recovery_timeout,omitempty"`
+}
+
+func (c *CircuitBreakerConfig) withDefaults() CircuitBreakerConfig {
+	cfg := *c
+	if cfg.WindowSize <= 0 {
+		cfg.WindowSize = 100
+	}
+	if cfg.ErrorThreshold <= 0 {
+		cfg.ErrorThreshold = 0.5
+	}
+	if cfg.RecoveryTimeout <= 0 {
+		cfg.RecoveryTimeout = 30 * time.Second
+	}
+	return cfg
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+// CircuitBreaker implements the standard closed -> open -> half-open state
+// machine in front of a single service's handler. A rolling window of the
+// last WindowSize responses decides when to trip; after RecoveryTimeout a
+// single probe request is allowed through in half-open state to decide
+// whether to close again or re-open.
+type CircuitBreaker struct {
+	service string
+	cfg     CircuitBreakerConfig
+
+	mu            sync.Mutex
+	state         breakerState
+	openedAt      time.Time
+	probeInFlight bool
+
+	results   []bool          // true = 5xx/error, ring buffer
+	latencies []time.Duration // parallel ring buffer
+	pos       int
+	filled    int
+}
+
+func newCircuitBreaker(service string, cfg CircuitBreakerConfig) *CircuitBreaker {
+	cfg = cfg.withDefaults()
+	cb := &CircuitBreaker{
+		service:   service,
+		cfg:       cfg,
+		results:   make([]bool, cfg.WindowSize),
+		latencies: make([]time.Duration, cfg.WindowSize),
+	}
+	circuitStateGauge.WithLabelValues(service).Set(float64(breakerClosed))
+	return cb
+}
+
+func (cb *CircuitBreaker) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed, isProbe := cb.allow()
+		if !allowed {
+			if rtr, ok := app.router.Load().(*Router); ok {
+				rtr.serveErrorPage(w, r, http.StatusServiceUnavailable)
+			} else {
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			}
+			return
+		}
+
+		res := NewResponseWriter(w)
+		start := time.Now()
+		next.ServeHTTP(res, r)
+		cb.record(res.statusCode >= 500, time.Since(start), isProbe)
+	})
+}
+
+// allow reports whether a request may proceed, and whether this particular
+// request is the single half-open probe.
+func (cb *CircuitBreaker) allow() (allowed bool, isProbe bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case breakerClosed:
+		return true, false
+	case breakerOpen:
+		if time.Since(cb.openedAt) < cb.cfg.RecoveryTimeout {
+			return false, false
+		}
+		cb.state = breakerHalfOpen
+		cb.probeInFlight = true
+		circuitStateGauge.WithLabelValues(cb.service).Set(float64(breakerHalfOpen))
+		return true, true
+	case breakerHalfOpen:
+		if cb.probeInFlight {
+			return false, false
+		}
+		cb.probeInFlight = true
+		return true, true
+	}
+	return true, false
+}
+
+func (cb *CircuitBreaker) record(isError bool, latency time.Duration, isProbe bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if isProbe {
+		cb.probeInFlight = false
+		if isError {
+			cb.state = breakerOpen
+			cb.openedAt = time.Now()
+			circuitStateGauge.WithLabelValues(cb.service).Set(float64(breakerOpen))
+		} else {
+			cb.state = breakerClosed
+			cb.filled = 0
+			cb.pos = 0
+			circuitStateGauge.WithLabelValues(cb.service).Set(float64(breakerClosed))
+		}
+		return
+	}
+
+	cb.results[cb.pos] = isError
+	cb.latencies[cb.pos] = latency
+	cb.pos = (cb.pos + 1) % len(cb.results)
+	if cb.filled < len(cb.results) {
+		cb.filled++
+	}
+
+	if cb.state != breakerClosed || cb.filled < len(cb.results) {
+		return
+	}
+
+	errors := 0
+	for _, v := range cb.results[:cb.filled] {
+		if v {
+			errors++
+		}
+	}
+	errorRatio := float64(errors) / float64(cb.filled)
+
+	tripped := errorRatio >= cb.cfg.ErrorThreshold
+	if !tripped && cb.cfg.LatencyThreshold > 0 {
+		tripped = p95(cb.latencies[:cb.filled]) >= cb.cfg.LatencyThreshold
+	}
+
+	if tripped {
+		logWarnf("circuit breaker '%s': tripping open (error ratio %.2f over last %d requests)", cb.service, errorRatio, cb.filled)
+		cb.state = breakerOpen
+		cb.openedAt = time.Now()
+		circuitStateGauge.WithLabelValues(cb.service).Set(float64(breakerOpen))
+	}
+}
+
+// p95 returns the 95th percentile latency in samples. It mutates a copy,
+// never the caller's slice.
+func p95(samples []time.Duration) time.Duration {
+	if len(samples) == 0 {
+		return 0
+	}
+	sorted := make([]time.Duration, len(samples))
+	copy(sorted, samples)
+	for i := 1; i < len(sorted); i++ {
+		for j := i; j > 0 && sorted[j-1] > sorted[j]; j-- {
+			sorted[j-1], sorted[j] = sorted[j], sorted[j-1]
+		}
+	}
+	idx := (len(sorted) * 95) / 100
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx]
+}
+
+// --- Rate limiter -------------------------------------------------------
+
+// RateLimitConfig configures a per-client-IP token bucket.
+type RateLimitConfig struct {
+	// RatePerSecond is the steady-state number of requests per second
+	// allowed for a single client IP.
+	RatePerSecond float64 `yaml:"rate,omitempty"`
+	// Burst is the bucket capacity, i.e. how many requests above the
+	// steady rate can be absorbed at once.
+	Burst int `yaml:"burst,omitempty"`
+}
+
+func (c *RateLimitConfig) withDefaults() RateLimitConfig {
+	cfg := *c
+	if cfg.RatePerSecond <= 0 {
+		cfg.RatePerSecond = 10
+	}
+	if cfg.Burst <= 0 {
+		cfg.Burst = int(cfg.RatePerSecond)
+		if cfg.Burst < 1 {
+			cfg.Burst = 1
+		}
+	}
+	return cfg
+}
+
+type tokenBucket struct {
+	mu       sync.Mutex
+	tokens   float64
+	lastSeen time.Time
+}
+
+// bucketTTL is how long a client IP's bucket can sit idle before the
+// reaper evicts it. Without this, RateLimiter.buckets grows by one entry
+// per distinct client IP ever seen and never shrinks - unbounded memory
+// growth under normal traffic on a public-facing proxy, not just abuse.
+const bucketTTL = 10 * time.Minute
+
+// RateLimiter is a token-bucket rate limiter keyed by client IP.
+type RateLimiter struct {
+	service string
+	cfg     RateLimitConfig
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// newRateLimiter starts a reaper goroutine, bound to ctx, that evicts
+// buckets idle for longer than bucketTTL. ctx is the router generation's
+// lifetime (cancelled on the next config reload), same as healthCtx.
+func newRateLimiter(ctx context.Context, service string, cfg RateLimitConfig) *RateLimiter {
+	rl := &RateLimiter{
+		service: service,
+		cfg:     cfg.withDefaults(),
+		buckets: make(map[string]*tokenBucket),
+	}
+	go rl.reapLoop(ctx)
+	return rl
+}
+
+// reapLoop periodically sweeps buckets that have been idle for longer
+// than bucketTTL, until ctx is cancelled.
+func (rl *RateLimiter) reapLoop(ctx context.Context) {
+	ticker := time.NewTicker(bucketTTL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rl.reap()
+		}
+	}
+}
+
+func (rl *RateLimiter) reap() {
+	cutoff := time.Now().Add(-bucketTTL)
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for key, b := range rl.buckets {
+		b.mu.Lock()
+		idle := b.lastSeen.Before(cutoff)
+		b.mu.Unlock()
+		if idle {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+func (rl *RateLimiter) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !rl.allow(clientIP(r)) {
+			rateLimitedTotal.WithLabelValues(rl.service).Inc()
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (rl *RateLimiter) allow(key string) bool {
+	rl.mu.Lock()
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(rl.cfg.Burst), lastSeen: time.Now()}
+		rl.buckets[key] = b
+	}
+	rl.mu.Unlock()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(b.lastSeen).Seconds()
+	b.lastSeen = now
+
+	b.tokens += elapsed * rl.cfg.RatePerSecond
+	if b.tokens > float64(rl.cfg.Burst) {
+		b.tokens = float64(rl.cfg.Burst)
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// clientIP returns the request's client address without the port, used as
+// the rate limiter's bucket key.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// trustedClientIP returns the client identity to treat as the request's
+// real origin: the first hop of X-Forwarded-For when the immediate peer
+// (RemoteAddr) is in trustedProxies, otherwise the peer itself. An
+// untrusted peer can set X-Forwarded-For to anything it likes, so it's
+// only honored once we know the hop handing us the request is one of our
+// own reverse proxies. Shared by the ip_hash strategy (loadbalancer.go)
+// and access logging (accesslog.go) so both agree on the same client.
+func trustedClientIP(r *http.Request, trustedProxies map[string]struct{}) string {
+	peer := clientIP(r)
+	if _, trusted := trustedProxies[peer]; trusted {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			if first := strings.TrimSpace(strings.Split(xff, ",")[0]); first != "" {
+				return first
+			}
+		}
+	}
+	return peer
+}
+
+// --- Retry ----------------------------------------------------------------
+
+// RetryConfig configures the retry middleware.
+type RetryConfig struct {
+	Attempts int `yaml:"attempts,omitempty"`
+}
+
+func (c *RetryConfig) withDefaults() RetryConfig {
+	cfg := *c
+	if cfg.Attempts <= 0 {
+		cfg.Attempts = 2
+	}
+	return cfg
+}
+
+// bufferedResponse collects a single attempt's status, headers, and body
+// entirely in memory instead of writing to the real http.ResponseWriter,
+// so retryMiddleware can discard a failed attempt instead of having
+// already streamed it to the client.
+type bufferedResponse struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header), statusCode: http.StatusOK}
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) WriteHeader(code int) { b.statusCode = code }
+
+func (b *bufferedResponse) Write(p []byte) (int, error) { return b.body.Write(p) }
+
+// flushTo writes the buffered attempt through to the real
+// http.ResponseWriter, exactly once.
+func (b *bufferedResponse) flushTo(w http.ResponseWriter) {
+	for k, v := range b.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(b.statusCode)
+	w.Write(b.body.Bytes())
+}
+
+// retryMiddleware tries idempotent (GET/HEAD) requests against next up
+// to cfg.Attempts times in total while the backend returns a 5xx. The request body,
+// for methods that have one, is buffered so it can be replayed. Each
+// attempt's response is buffered in memory rather than written straight
+// through, since a 5xx on attempt 1 is exactly the case we're retrying -
+// writing it to the client before deciding to retry would both leak a
+// bad response and corrupt attempt 2's on top of it.
+func retryMiddleware(cfg RetryConfig) Middleware {
+	cfg = cfg.withDefaults()
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			var bodyBytes []byte
+			if r.Body != nil {
+				bodyBytes, _ = io.ReadAll(r.Body)
+				r.Body.Close()
+			}
+
+			var res *bufferedResponse
+			for attempt := 1; attempt <= cfg.Attempts; attempt++ {
+				if bodyBytes != nil {
+					r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+				}
+				res = newBufferedResponse()
+				next.ServeHTTP(res, r)
+				if res.statusCode < 500 || attempt == cfg.Attempts {
+					break
+				}
+				logDebugf("retry middleware: attempt %d for '%s' returned %d, retrying", attempt, r.URL.Path, res.statusCode)
+			}
+			res.flushTo(w)
+		})
+	}
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v2"
+)
+
+// Provider is anything that can discover services/routes and push updated
+// Config snapshots to Clara. File-based YAML, Docker container labels, and a
+// built-in static provider all implement this interface so the main loop
+// doesn't need to know where a Config came from.
+type Provider interface {
+	// Provide starts discovery and sends a Config on updates channel every
+	// time this provider's view of the world changes. It must block until
+	// ctx is cancelled, cleaning up any watches/subscriptions before it
+	// returns.
+	Provide(ctx context.Context, updates chan<- Config) error
+}
+
+// ProviderConfig lists which providers are active and how they're
+// configured. It is itself loaded from config.yaml (or the embedded
+// defaults) before the providers it describes take over.
+type ProviderConfig struct {
+	File   *FileProviderConfig   `yaml:"file,omitempty"`
+	Docker *DockerProviderConfig `yaml:"docker,omitempty"`
+	Static *StaticProviderConfig `yaml:"static,omitempty"`
+}
+
+// --- File provider ---------------------------------------------------------
+
+// FileProviderConfig configures the file provider. Note that Paths can't
+// retarget the file provider that discovered it: runProviders starts the
+// file provider against the default search paths (plus --config/
+// CLARA_CONFIG) before any config.yaml has been read, so there's nowhere
+// upstream of that file for a `providers.file.paths` override to come
+// from. It's accepted for forwards compatibility with providers (e.g.
+// docker) that might one day want to point a *second* file watch
+// elsewhere.
+type FileProviderConfig struct {
+	Paths []string `yaml:"paths,omitempty"`
+}
+
+// FileProvider watches a YAML config file with fsnotify and re-parses it on
+// every write, replacing the polling `os.Stat` loop that used to live in
+// main(). It's the default provider and preserves Clara's original
+// behavior: a single `config.yaml` searched for across the usual paths.
+type FileProvider struct {
+	paths []string
+}
+
+// NewFileProvider returns a FileProvider that searches paths in order and
+// watches whichever one exists first. If paths is empty, the historical
+// default search paths are used.
+func NewFileProvider(paths []string) *FileProvider {
+	if len(paths) == 0 {
+		paths = defaultConfigPaths()
+	}
+	return &FileProvider{paths: paths}
+}
+
+// defaultConfigPaths returns the search paths the file provider tries in
+// order. When --config / CLARA_CONFIG names a path, it's tried first.
+func defaultConfigPaths() []string {
+	paths := []string{
+		"./config.yaml",
+		os.Getenv("HOME") + "/.config/clara/config.yaml",
+		"/etc/clara/config.yaml",
+	}
+	if runtimeConfig != nil && runtimeConfig.ConfigPath != "" {
+		return append([]string{runtimeConfig.ConfigPath}, paths...)
+	}
+	return paths
+}
+
+func (p *FileProvider) load(foundPath string) (Config, error) {
+	var cfg Config
+	data, err := os.ReadFile(foundPath)
+	if err != nil {
+		return cfg, fmt.Errorf("reading config '%s': %w", foundPath, err)
+	}
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("parsing config '%s': %w", foundPath, err)
+	}
+	return cfg, nil
+}
+
+// Provide implements Provider. It emits one Config immediately, then again
+// every time the watched file is written.
+func (p *FileProvider) Provide(ctx context.Context, updates chan<- Config) error {
+	foundPath := ""
+	for _, path := range p.paths {
+		if _, err := os.Stat(path); err == nil {
+			foundPath = path
+			break
+		}
+	}
+
+	if foundPath == "" {
+		logInfof("No user-provided config found. Loading built-in default configuration.")
+		data, err := defaultPages.ReadFile("defaults/config.default.yaml")
+		if err != nil {
+			return fmt.Errorf("failed to load embedded default config: %w", err)
+		}
+		var cfg Config
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return fmt.Errorf("error parsing embedded default config: %w", err)
+		}
+		updates <- cfg
+		<-ctx.Done()
+		return nil
+	}
+
+	logInfof("file provider: watching %s", foundPath)
+	cfg, err := p.load(foundPath)
+	if err != nil {
+		return err
+	}
+	updates <- cfg
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("file provider: creating watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(foundPath); err != nil {
+		return fmt.Errorf("file provider: watching '%s': %w", foundPath, err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			cfg, err := p.load(foundPath)
+			if err != nil {
+				logErrorf("file provider: reload failed: %v", err)
+				continue
+			}
+			logInfof("file provider: %s changed, reloading", foundPath)
+			updates <- cfg
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			logErrorf("file provider: watcher error: %v", err)
+		}
+	}
+}
+
+// --- Static provider ---------------------------------------------------------
+
+// StaticProviderConfig lets an operator embed a fixed Config directly in
+// the provider block, useful for defaults or tests with no moving parts.
+type StaticProviderConfig struct {
+	Services []Service `yaml:"services,omitempty"`
+	Routes   []Route   `yaml:"routes,omitempty"`
+}
+
+// StaticProvider emits a single, unchanging Config and then exits once the
+// context is cancelled. runProviders starts it only when the file
+// provider's config has a `providers.static` block.
+type StaticProvider struct {
+	cfg Config
+}
+
+// NewStaticProvider returns a StaticProvider that always emits cfg.
+func NewStaticProvider(cfg Config) *StaticProvider {
+	return &StaticProvider{cfg: cfg}
+}
+
+// Provide implements Provider.
+func (p *StaticProvider) Provide(ctx context.Context, updates chan<- Config) error {
+	updates <- p.cfg
+	<-ctx.Done()
+	return nil
+}
+
+// --- Docker provider ---------------------------------------------------------
+
+// DockerProviderConfig configures discovery of routes from running
+// containers.
+type DockerProviderConfig struct {
+	// Endpoint is the Docker Engine API socket, e.g. "/var/run/docker.sock".
+	Endpoint string `yaml:"endpoint,omitempty"`
+	// LabelPrefix is the label namespace containers opt in with, e.g.
+	// "clara" for "clara.route" / "clara.port".
+	LabelPrefix string `yaml:"label_prefix,omitempty"`
+}
+
+// DockerProvider discovers services by subscribing to the Docker Engine
+// events API over the local Unix socket and inspecting containers tagged
+// with `<prefix>.route` and `<prefix>.port` labels. It deliberately avoids
+// pulling in the full Docker SDK: Clara only needs a handful of read-only
+// endpoints, so it talks to the socket with a plain HTTP client.
+type DockerProvider struct {
+	endpoint    string
+	labelPrefix string
+	client      *http.Client
+}
+
+// NewDockerProvider returns a DockerProvider reading from endpoint (default
+// "/var/run/docker.sock") and watching labels under labelPrefix (default
+// "clara").
+func NewDockerProvider(cfg DockerProviderConfig) *DockerProvider {
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = "/var/run/docker.sock"
+	}
+	labelPrefix := cfg.LabelPrefix
+	if labelPrefix == "" {
+		labelPrefix = "clara"
+	}
+	return &DockerProvider{
+		endpoint:    endpoint,
+		labelPrefix: labelPrefix,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", endpoint)
+				},
+			},
+		},
+	}
+}
+
+type dockerContainer struct {
+	Id     string
+	Names  []string
+	Labels map[string]string
+	State  string
+}
+
+type dockerEvent struct {
+	Type   string `json:"Type"`
+	Action string `json:"Action"`
+}
+
+// Provide implements Provider. It does an initial container listing, then
+// streams the Docker events API and re-synthesizes a Config whenever a
+// container starts, stops, or dies.
+func (p *DockerProvider) Provide(ctx context.Context, updates chan<- Config) error {
+	cfg, err := p.discover(ctx)
+	if err != nil {
+		return fmt.Errorf("docker provider: initial discovery: %w", err)
+	}
+	updates <- cfg
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://docker/events?filters="+url.QueryEscape(`{"type":["container"]}`), nil)
+	if err != nil {
+		return fmt.Errorf("docker provider: building events request: %w", err)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("docker provider: subscribing to events: %w", err)
+	}
+	defer resp.Body.Close()
+
+	logInfof("docker provider: subscribed to container events")
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var ev dockerEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			continue
+		}
+		switch ev.Action {
+		case "start", "die", "stop", "kill", "destroy":
+			cfg, err := p.discover(ctx)
+			if err != nil {
+				logErrorf("docker provider: re-discovery after '%s' failed: %v", ev.Action, err)
+				continue
+			}
+			logInfof("docker provider: container %s event, refreshing routes", ev.Action)
+			updates <- cfg
+		}
+	}
+	return scanner.Err()
+}
+
+// discover lists running containers and turns any tagged with
+// "<prefix>.route" and "<prefix>.port" into a Service + Route pair.
+func (p *DockerProvider) discover(ctx context.Context) (Config, error) {
+	var cfg Config
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://docker/containers/json", nil)
+	if err != nil {
+		return cfg, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return cfg, err
+	}
+	defer resp.Body.Close()
+
+	var containers []dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return cfg, fmt.Errorf("decoding container list: %w", err)
+	}
+
+	routeLabel := p.labelPrefix + ".route"
+	portLabel := p.labelPrefix + ".port"
+
+	for _, c := range containers {
+		route, ok := c.Labels[routeLabel]
+		if !ok {
+			continue
+		}
+		port, ok := c.Labels[portLabel]
+		if !ok {
+			continue
+		}
+		portNum, err := strconv.Atoi(port)
+		if err != nil {
+			logWarnf("docker provider: container %s has non-numeric %s=%q, skipping", c.Id[:12], portLabel, port)
+			continue
+		}
+
+		name := strings.TrimPrefix(firstOr(c.Names, c.Id), "/")
+		cfg.Services = append(cfg.Services, Service{
+			Name: name,
+			Host: name,
+			Port: portNum,
+		})
+		cfg.Routes = append(cfg.Routes, Route{
+			Path:    route,
+			Service: name,
+		})
+	}
+
+	return cfg, nil
+}
+
+func firstOr(names []string, fallback string) string {
+	if len(names) > 0 {
+		return names[0]
+	}
+	return fallback
+}
+
+// mergeConfigs combines the latest Config known from each provider into a
+// single effective Config. Providers are merged in the order given by
+// order (runProviders uses static, then docker, then file) so that, when
+// two providers declare the same service or route, the later provider in
+// that order wins - an operator's file config overrides auto-discovered
+// Docker routes, which override static ones.
+func mergeConfigs(order []string, latest map[string]Config) Config {
+	var merged Config
+	serviceIdx := make(map[string]int)
+	routeIdx := make(map[string]int)
+
+	for _, name := range order {
+		cfg, ok := latest[name]
+		if !ok {
+			continue
+		}
+		if cfg.TLS != nil {
+			merged.TLS = cfg.TLS
+		}
+		if cfg.AccessLog != nil {
+			merged.AccessLog = cfg.AccessLog
+		}
+		if cfg.Server != nil {
+			merged.Server = cfg.Server
+		}
+		if cfg.ErrorPages != nil {
+			if merged.ErrorPages == nil {
+				merged.ErrorPages = map[int]string{}
+			}
+			for code, page := range cfg.ErrorPages {
+				merged.ErrorPages[code] = page
+			}
+		}
+		for _, svc := range cfg.Services {
+			if i, exists := serviceIdx[svc.Name]; exists {
+				merged.Services[i] = svc
+			} else {
+				serviceIdx[svc.Name] = len(merged.Services)
+				merged.Services = append(merged.Services, svc)
+			}
+		}
+		for _, route := range cfg.Routes {
+			if i, exists := routeIdx[route.Path]; exists {
+				merged.Routes[i] = route
+			} else {
+				routeIdx[route.Path] = len(merged.Routes)
+				merged.Routes = append(merged.Routes, route)
+			}
+		}
+	}
+
+	return merged
+}
+
+// runProviders starts the file provider, aggregates Config updates from it
+// and from whichever other providers its `providers:` block names, merges
+// them, and stores the result as app's active router on every change.
+//
+// There is deliberately no separate bootstrap read of config.yaml before
+// this loop starts: every Config the file provider emits carries the
+// `providers:` block, which is used here to lazily start docker/static -
+// so the file is only ever parsed by one code path. start is idempotent
+// (it no-ops if the named provider is already running), so re-checking
+// Providers on every file update costs nothing once docker/static are up,
+// and means adding a providers.docker/providers.static block to a running
+// Clara's config.yaml takes effect on the next file-provider update
+// instead of being silently ignored until a restart. The merged Config is
+// also published on the returned channel, whose first value is the
+// startup snapshot main() needs for TLS and access-log setup, so callers
+// never have to read a Config a second goroutine might concurrently be
+// replacing.
+func runProviders(ctx context.Context) <-chan Config {
+	updates := make(chan namedConfig)
+	merged := make(chan Config)
+
+	var startMu sync.Mutex
+	started := make(map[string]bool)
+	start := func(name string, p Provider) {
+		startMu.Lock()
+		if started[name] {
+			startMu.Unlock()
+			return
+		}
+		started[name] = true
+		startMu.Unlock()
+
+		go func() {
+			wrapped := make(chan Config)
+			go func() {
+				for cfg := range wrapped {
+					updates <- namedConfig{name: name, cfg: cfg}
+				}
+			}()
+			if err := p.Provide(ctx, wrapped); err != nil && ctx.Err() == nil {
+				logErrorf("provider '%s' stopped: %v", name, err)
+			}
+			close(wrapped)
+		}()
+	}
+
+	// The file provider always runs, even with an empty providers block,
+	// so Clara keeps working exactly as it used to with just a
+	// config.yaml and nothing else.
+	start("file", NewFileProvider(nil))
+
+	order := []string{"static", "docker", "file"}
+	go func() {
+		defer close(merged)
+
+		latest := make(map[string]Config)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case nc := <-updates:
+				latest[nc.name] = nc.cfg
+
+				if nc.name == "file" {
+					if nc.cfg.Providers.Static != nil {
+						start("static", NewStaticProvider(Config{
+							Services: nc.cfg.Providers.Static.Services,
+							Routes:   nc.cfg.Providers.Static.Routes,
+						}))
+					}
+					if nc.cfg.Providers.Docker != nil {
+						start("docker", NewDockerProvider(*nc.cfg.Providers.Docker))
+					}
+				}
+
+				mergedCfg := mergeConfigs(order, latest)
+				app.router.Store(app.newRouter(&mergedCfg))
+				logInfof("provider '%s' updated routing table (%d routes)", nc.name, len(mergedCfg.Routes))
+
+				select {
+				case merged <- mergedCfg:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return merged
+}
+
+type namedConfig struct {
+	name string
+	cfg  Config
+}